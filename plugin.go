@@ -1,28 +1,84 @@
+// Package traefik_api_key_auth is a Traefik plugin, loaded through Yaegi,
+// which only interprets plain Go source and cannot pull in third-party
+// modules. That's why hashing (pbkdf2-sha256 instead of bcrypt) and rate
+// limiting (tokenBucket instead of golang.org/x/time/rate) are implemented
+// below using only the standard library.
 package traefik_api_key_auth
 
 import (
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Config struct {
-	AuthenticationHeader       bool     `json:"authenticationHeader,omitempty"`
-	AuthenticationHeaderName   string   `json:"headerName,omitempty"`
-	BearerHeader               bool     `json:"bearerHeader,omitempty"`
-	BearerHeaderName           string   `json:"bearerHeaderName,omitempty"`
-	QueryParam                 bool     `json:"queryParam,omitempty"`
-	QueryParamName             string   `json:"queryParamName,omitempty"`
-	PathSegment                bool     `json:"pathSegment,omitempty"`
+	AuthenticationHeader       bool          `json:"authenticationHeader,omitempty"`
+	AuthenticationHeaderName   string        `json:"headerName,omitempty"`
+	BearerHeader               bool          `json:"bearerHeader,omitempty"`
+	BearerHeaderName           string        `json:"bearerHeaderName,omitempty"`
+	QueryParam                 bool          `json:"queryParam,omitempty"`
+	QueryParamName             string        `json:"queryParamName,omitempty"`
+	PathSegment                bool          `json:"pathSegment,omitempty"`
 	RemoveQueryParamsOnSuccess bool		`json:"removeQueryParamsOnSuccess,omitempty"`
-	Keys                       []string `json:"keys,omitempty"`
-	RemoveHeadersOnSuccess     bool     `json:"removeHeadersOnSuccess,omitempty"`
-	InternalForwardHeaderName  string   `json:"internalForwardHeaderName,omitempty"`
-	InternalErrorRoute         string   `json:"internalErrorRoute,omitempty"`
+	TokenLookup                string        `json:"tokenLookup,omitempty"`
+	Keys                       []string      `json:"keys,omitempty"`
+	HashedKeys                 []string      `json:"hashedKeys,omitempty"`
+	HashedKeyCacheSize         int           `json:"hashedKeyCacheSize,omitempty"`
+	HashedKeyCacheTTL          time.Duration `json:"hashedKeyCacheTTL,omitempty"`
+	RemoveHeadersOnSuccess     bool          `json:"removeHeadersOnSuccess,omitempty"`
+	InternalForwardHeaderName  string        `json:"internalForwardHeaderName,omitempty"`
+	InternalErrorRoute         string        `json:"internalErrorRoute,omitempty"`
+	WebhookURL                 string        `json:"webhookURL,omitempty"`
+	WebhookTimeout             time.Duration `json:"webhookTimeout,omitempty"`
+	WebhookCACert              string        `json:"webhookCACert,omitempty"`
+	WebhookForwardHeaders      []string      `json:"webhookForwardHeaders,omitempty"`
+	WebhookCacheSize           int           `json:"webhookCacheSize,omitempty"`
+	WebhookCacheHitTTL         time.Duration `json:"webhookCacheHitTTL,omitempty"`
+	WebhookCacheMissTTL        time.Duration `json:"webhookCacheMissTTL,omitempty"`
+	KeyPolicies                []KeyPolicy   `json:"keyPolicies,omitempty"`
+	KeysFile                   string            `json:"keysFile,omitempty"`
+	KeysURL                    string            `json:"keysURL,omitempty"`
+	KeysRefreshInterval        time.Duration     `json:"keysRefreshInterval,omitempty"`
+	KeysURLHeaders             map[string]string `json:"keysURLHeaders,omitempty"`
+	RateLimitRequestsPerSecond float64           `json:"rateLimitRequestsPerSecond,omitempty"`
+	RateLimitBurst             int               `json:"rateLimitBurst,omitempty"`
+	RateLimitIdleTTL           time.Duration     `json:"rateLimitIdleTTL,omitempty"`
+}
+
+// KeyPolicy scopes a single key to a subset of methods and/or paths, so one
+// Traefik router can host several keys with different privilege levels
+// instead of requiring one router per privilege tier. At least one of
+// Methods, PathPrefixes or PathRegex must be set; an empty field means "any".
+// RateLimitRequestsPerSecond/RateLimitBurst override the global RateLimit
+// settings for this key; zero means "use the global default".
+type KeyPolicy struct {
+	Key                        string   `json:"key"`
+	Methods                    []string `json:"methods,omitempty"`
+	PathPrefixes               []string `json:"pathPrefixes,omitempty"`
+	PathRegex                  string   `json:"pathRegex,omitempty"`
+	ForwardIdentity            string   `json:"forwardIdentity,omitempty"`
+	RateLimitRequestsPerSecond float64  `json:"rateLimitRequestsPerSecond,omitempty"`
+	RateLimitBurst             int      `json:"rateLimitBurst,omitempty"`
 }
 
 type Response struct {
@@ -40,24 +96,238 @@ func CreateConfig() *Config {
 		QueryParamName:            "token",
 		PathSegment:               true,
 		RemoveQueryParamsOnSuccess:true,
+		TokenLookup:               "",
 		Keys:                      make([]string, 0),
+		HashedKeys:                make([]string, 0),
+		HashedKeyCacheSize:        1024,
+		HashedKeyCacheTTL:         5 * time.Minute,
 		RemoveHeadersOnSuccess:    true,
 		InternalForwardHeaderName: "",
 		InternalErrorRoute:        "",
+		KeysRefreshInterval:       time.Minute,
+		KeysURLHeaders:            make(map[string]string),
+		WebhookURL:                "",
+		WebhookTimeout:            5 * time.Second,
+		WebhookForwardHeaders:     make([]string, 0),
+		WebhookCacheSize:          1024,
+		WebhookCacheHitTTL:        5 * time.Minute,
+		WebhookCacheMissTTL:       10 * time.Second,
+		KeyPolicies:               make([]KeyPolicy, 0),
+		RateLimitIdleTTL:          10 * time.Minute,
 	}
 }
 
+// lookupSource identifies where a tokenExtractor reads its candidate token from.
+type lookupSource int
+
+const (
+	sourceHeader lookupSource = iota
+	sourceQuery
+	sourceCookie
+	sourcePath
+	sourceForm
+)
+
+// tokenExtractor is a single parsed entry of a TokenLookup DSL string, e.g.
+// "header:Authorization:Bearer " or "path:2". ServeHTTP walks a slice of
+// these in declared order until one yields a token that matches a
+// configured key.
+type tokenExtractor struct {
+	source    lookupSource
+	name      string // header/query/cookie/form name; unused for path
+	prefix    string // header-only, e.g. "Bearer " stripped from the value
+	pathIndex int     // path-only; -1 means "match anywhere in the path" (legacy pathSegment behaviour)
+	exact     bool    // false only for the legacy whole-path substring match
+	raw       string  // original DSL entry, kept for error messages
+}
+
+// extract pulls the raw candidate token for this extractor out of the
+// request, along with a function that strips the token from its source.
+// The remove function is nil when there is nothing sensible to strip (path
+// segments are never rewritten). For form fields it only deletes the parsed
+// req.PostForm value; the request body is forwarded as received.
+func (e tokenExtractor) extract(req *http.Request) (string, func(*http.Request)) {
+	switch e.source {
+	case sourceHeader:
+		value := req.Header.Get(e.name)
+		if value == "" {
+			return "", nil
+		}
+		if e.prefix != "" {
+			if !strings.HasPrefix(value, e.prefix) {
+				return "", nil
+			}
+			// Entries are whitespace-trimmed when parsed, so a "Bearer " prefix
+			// arrives as "Bearer"; drop the separating space here too.
+			value = strings.TrimLeft(strings.TrimPrefix(value, e.prefix), " ")
+		}
+		name := e.name
+		return value, func(r *http.Request) { r.Header.Del(name) }
+
+	case sourceQuery:
+		qs := req.URL.Query()
+		value := qs.Get(e.name)
+		if value == "" {
+			return "", nil
+		}
+		name := e.name
+		return value, func(r *http.Request) {
+			qs := r.URL.Query()
+			qs.Del(name)
+			r.URL.RawQuery = qs.Encode()
+		}
+
+	case sourceCookie:
+		cookie, err := req.Cookie(e.name)
+		if err != nil || cookie.Value == "" {
+			return "", nil
+		}
+		name := e.name
+		return cookie.Value, func(r *http.Request) {
+			var kept []string
+			for _, c := range r.Cookies() {
+				if c.Name == name {
+					continue
+				}
+				kept = append(kept, (&http.Cookie{Name: c.Name, Value: c.Value}).String())
+			}
+			if len(kept) == 0 {
+				r.Header.Del("Cookie")
+			} else {
+				r.Header.Set("Cookie", strings.Join(kept, "; "))
+			}
+		}
+
+	case sourceForm:
+		// ParseForm drains req.Body for POST/PUT/PATCH requests and nothing
+		// else refills it, so the backend would otherwise see an empty body
+		// even for requests that don't end up authenticating via this
+		// source. Tee the body into a buffer first and restore it after.
+		var body []byte
+		if req.Body != nil {
+			var err error
+			body, err = io.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return "", nil
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		err := req.ParseForm()
+		if req.Body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if err != nil {
+			return "", nil
+		}
+
+		value := req.PostForm.Get(e.name)
+		if value == "" {
+			return "", nil
+		}
+		name := e.name
+		return value, func(r *http.Request) { r.PostForm.Del(name) }
+
+	case sourcePath:
+		if e.pathIndex < 0 {
+			// Legacy pathSegment behaviour: the key may appear anywhere in the path.
+			return req.URL.Path, nil
+		}
+		segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if e.pathIndex >= len(segments) {
+			return "", nil
+		}
+		return segments[e.pathIndex], nil
+	}
+	return "", nil
+}
+
+// parseTokenLookup parses a TokenLookup DSL string of the form
+// "source:name[:prefix],source:name[:prefix],..." into an ordered slice of
+// extractors. Supported sources are header, query, cookie, form and path
+// (which takes a zero-based segment index instead of a name).
+func parseTokenLookup(spec string) ([]tokenExtractor, error) {
+	var extractors []tokenExtractor
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		extractor, err := parseTokenLookupEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		extractors = append(extractors, extractor)
+	}
+	return extractors, nil
+}
+
+func parseTokenLookupEntry(raw string) (tokenExtractor, error) {
+	parts := strings.SplitN(raw, ":", 3)
+	if len(parts) < 2 {
+		return tokenExtractor{}, fmt.Errorf("invalid tokenLookup entry %q: expected source:name", raw)
+	}
+
+	source, name := parts[0], parts[1]
+	var prefix string
+	if len(parts) == 3 {
+		prefix = parts[2]
+	}
+
+	switch source {
+	case "header":
+		return tokenExtractor{source: sourceHeader, name: name, prefix: prefix, exact: true, raw: raw}, nil
+	case "query":
+		return tokenExtractor{source: sourceQuery, name: name, exact: true, raw: raw}, nil
+	case "cookie":
+		return tokenExtractor{source: sourceCookie, name: name, exact: true, raw: raw}, nil
+	case "form":
+		return tokenExtractor{source: sourceForm, name: name, exact: true, raw: raw}, nil
+	case "path":
+		idx, err := strconv.Atoi(name)
+		if err != nil {
+			return tokenExtractor{}, fmt.Errorf("invalid tokenLookup entry %q: path source requires a numeric segment index", raw)
+		}
+		return tokenExtractor{source: sourcePath, pathIndex: idx, exact: true, raw: raw}, nil
+	default:
+		return tokenExtractor{}, fmt.Errorf("invalid tokenLookup entry %q: unknown source %q", raw, source)
+	}
+}
+
+// legacyTokenLookup translates the four boolean/name config pairs into the
+// equivalent tokenExtractor slice, preserving their original cascade order,
+// so ServeHTTP only ever has to walk one kind of list.
+func legacyTokenLookup(config *Config) []tokenExtractor {
+	var extractors []tokenExtractor
+
+	if config.AuthenticationHeader {
+		extractors = append(extractors, tokenExtractor{source: sourceHeader, name: config.AuthenticationHeaderName, exact: true})
+	}
+	if config.BearerHeader {
+		extractors = append(extractors, tokenExtractor{source: sourceHeader, name: config.BearerHeaderName, prefix: "Bearer ", exact: true})
+	}
+	if config.QueryParam {
+		extractors = append(extractors, tokenExtractor{source: sourceQuery, name: config.QueryParamName, exact: true})
+	}
+	if config.PathSegment {
+		extractors = append(extractors, tokenExtractor{source: sourcePath, pathIndex: -1, exact: false})
+	}
+
+	return extractors
+}
+
 type KeyAuth struct {
 	next                       http.Handler
-	authenticationHeader       bool
-	authenticationHeaderName   string
-	bearerHeader               bool
-	bearerHeaderName           string
-	queryParam                 bool
-	queryParamName             string
-	pathSegment                bool
+	lookups                    []tokenExtractor
 	removeQueryParamsOnSuccess bool
 	keys                       []string
+	hashedKeys                 []string
+	hashedKeyCache             *hashCache
+	webhook                    *webhookAuthenticator
+	policies                   map[string]*compiledPolicy
+	dynamicKeys                *dynamicKeySource
+	rateLimiter                *rateLimiter
 	removeHeadersOnSuccess     bool
 	internalForwardHeaderName  string
 	internalErrorRoute         string
@@ -66,33 +336,716 @@ type KeyAuth struct {
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
 	fmt.Printf("Creating plugin: %s instance: %+v, ctx: %+v\n", name, *config, ctx)
 
-	// check for empty keys
-	if len(config.Keys) == 0 {
+	// check for empty keys; a webhook or a hot-reloaded key source can stand in for a static key list entirely
+	if len(config.Keys) == 0 && len(config.HashedKeys) == 0 && len(config.KeyPolicies) == 0 &&
+		config.WebhookURL == "" && config.KeysFile == "" && config.KeysURL == "" {
 		return nil, fmt.Errorf("must specify at least one valid key")
 	}
 
+	// check that every hashed key is actually a parseable pbkdf2-sha256 hash,
+	// so misconfiguration is caught at startup rather than on the first request
+	for _, hashedKey := range config.HashedKeys {
+		if _, _, _, err := parseHashedKey(hashedKey); err != nil {
+			return nil, fmt.Errorf("invalid entry in hashedKeys: %w", err)
+		}
+	}
+
+	var lookups []tokenExtractor
+	if config.TokenLookup != "" {
+		parsed, err := parseTokenLookup(config.TokenLookup)
+		if err != nil {
+			return nil, err
+		}
+		lookups = parsed
+	} else {
+		lookups = legacyTokenLookup(config)
+	}
+
 	// check at least one method is set
-	if !config.AuthenticationHeader && !config.BearerHeader && !config.QueryParam && !config.PathSegment {
-		return nil, fmt.Errorf("at least one method must be true")
+	if len(lookups) == 0 {
+		return nil, fmt.Errorf("at least one token lookup source must be configured")
+	}
+
+	cacheSize := config.HashedKeyCacheSize
+	if cacheSize <= 0 {
+		cacheSize = 1024
+	}
+
+	webhook, err := newWebhookAuthenticator(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// KeyPolicy.Key is an additional, scoped key: fold it into the plaintext
+	// keys so it is matched exactly like an unscoped key, then look up its
+	// policy by the matched key once authenticated.
+	keys := append([]string{}, config.Keys...)
+	policies := make(map[string]*compiledPolicy, len(config.KeyPolicies))
+	for _, keyPolicy := range config.KeyPolicies {
+		if keyPolicy.Key == "" {
+			return nil, fmt.Errorf("keyPolicies entry is missing a key")
+		}
+		if len(keyPolicy.Methods) == 0 && len(keyPolicy.PathPrefixes) == 0 && keyPolicy.PathRegex == "" {
+			return nil, fmt.Errorf("keyPolicies entry for key %q must set at least one of methods, pathPrefixes or pathRegex", keyPolicy.Key)
+		}
+
+		compiled := &compiledPolicy{forwardIdentity: keyPolicy.ForwardIdentity, pathPrefixes: keyPolicy.PathPrefixes}
+		if len(keyPolicy.Methods) > 0 {
+			compiled.methods = make(map[string]bool, len(keyPolicy.Methods))
+			for _, method := range keyPolicy.Methods {
+				compiled.methods[strings.ToUpper(method)] = true
+			}
+		}
+		if keyPolicy.PathRegex != "" {
+			re, err := regexp.Compile(keyPolicy.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pathRegex for key %q: %w", keyPolicy.Key, err)
+			}
+			compiled.pathRegex = re
+		}
+
+		policies[keyPolicy.Key] = compiled
+		keys = append(keys, keyPolicy.Key)
+	}
+
+	dynamicKeys, err := newDynamicKeySource(ctx, config)
+	if err != nil {
+		return nil, err
 	}
 
 	return &KeyAuth{
 		next:                       next,
-		authenticationHeader:       config.AuthenticationHeader,
-		authenticationHeaderName:   config.AuthenticationHeaderName,
-		bearerHeader:               config.BearerHeader,
-		bearerHeaderName:           config.BearerHeaderName,
-		queryParam:                 config.QueryParam,
-		queryParamName:             config.QueryParamName,
-		pathSegment:                config.PathSegment,
+		lookups:                    lookups,
 		removeQueryParamsOnSuccess: config.RemoveQueryParamsOnSuccess,
-		keys:                       config.Keys,
+		keys:                       keys,
+		hashedKeys:                 config.HashedKeys,
+		hashedKeyCache:             newHashCache(cacheSize, config.HashedKeyCacheTTL),
+		webhook:                    webhook,
+		policies:                   policies,
+		dynamicKeys:                dynamicKeys,
+		rateLimiter:                newRateLimiter(ctx, config),
 		removeHeadersOnSuccess:     config.RemoveHeadersOnSuccess,
 		internalForwardHeaderName:  config.InternalForwardHeaderName,
 		internalErrorRoute:         config.InternalErrorRoute,
 	}, nil
 }
 
+// dynamicKeyEntry is one key loaded from KeysFile/KeysURL, optionally
+// carrying an operator-assigned id used as the forwarded identifier instead
+// of the raw key.
+type dynamicKeyEntry struct {
+	Key string `json:"key"`
+	ID  string `json:"id"`
+}
+
+// dynamicKeysDocument is the JSON schema accepted for KeysFile/KeysURL.
+type dynamicKeysDocument struct {
+	Keys []dynamicKeyEntry `json:"keys"`
+}
+
+// dynamicKeySource hot-reloads a key set from a file or URL on a background
+// goroutine, publishing each refresh through an atomic pointer so ServeHTTP
+// can read the current snapshot without taking a lock. On a refresh error
+// the last-known-good snapshot keeps serving and the error is only logged.
+type dynamicKeySource struct {
+	file         string
+	url          string
+	headers      map[string]string
+	client       *http.Client
+	etag         string
+	lastModified string
+	entries      atomic.Pointer[[]dynamicKeyEntry]
+}
+
+// newDynamicKeySource builds a dynamicKeySource from config, performs its
+// initial load synchronously (so the plugin never starts up with an empty
+// key set), and spawns the periodic refresh goroutine bound to ctx. It
+// returns a nil source (and no error) when neither KeysFile nor KeysURL is set.
+func newDynamicKeySource(ctx context.Context, config *Config) (*dynamicKeySource, error) {
+	if config.KeysFile == "" && config.KeysURL == "" {
+		return nil, nil
+	}
+
+	source := &dynamicKeySource{
+		file:    config.KeysFile,
+		url:     config.KeysURL,
+		headers: config.KeysURLHeaders,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	entries, err := source.load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load initial key set: %w", err)
+	}
+	source.entries.Store(&entries)
+
+	interval := config.KeysRefreshInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go source.run(ctx, interval)
+
+	return source, nil
+}
+
+// run periodically refreshes the key set until ctx is cancelled.
+func (s *dynamicKeySource) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			entries, err := s.load()
+			if err != nil {
+				fmt.Printf("ERROR: traefik_api_key_auth: failed to refresh keys, keeping last-known-good set: %s\n", err.Error())
+				continue
+			}
+			s.entries.Store(&entries)
+		}
+	}
+}
+
+// load fetches and parses the key set from disk or HTTP. For the URL
+// variant it sends If-None-Match/If-Modified-Since and, on a 304 response,
+// returns the previously loaded entries unchanged.
+func (s *dynamicKeySource) load() ([]dynamicKeyEntry, error) {
+	if s.file != "" {
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			return nil, err
+		}
+		return parseDynamicKeys(data), nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		if current := s.entries.Load(); current != nil {
+			return *current, nil
+		}
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, s.url)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+
+	return parseDynamicKeys(data), nil
+}
+
+// parseDynamicKeys accepts either the {"keys":[{"key":"...","id":"..."}]}
+// JSON schema or a plain newline-delimited list of keys (blank lines and
+// "#"-prefixed comments are skipped).
+func parseDynamicKeys(data []byte) []dynamicKeyEntry {
+	var doc dynamicKeysDocument
+	if err := json.Unmarshal(data, &doc); err == nil && len(doc.Keys) > 0 {
+		return doc.Keys
+	}
+
+	var entries []dynamicKeyEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, dynamicKeyEntry{Key: line})
+	}
+	return entries
+}
+
+// match looks up token against the current snapshot, returning the entry's
+// id if set, otherwise the key itself.
+func (s *dynamicKeySource) match(token string) string {
+	if s == nil {
+		return ""
+	}
+	entries := s.entries.Load()
+	if entries == nil {
+		return ""
+	}
+	for _, entry := range *entries {
+		if entry.Key == token {
+			if entry.ID != "" {
+				return entry.ID
+			}
+			return entry.Key
+		}
+	}
+	return ""
+}
+
+// rateLimitSpec is a resolved (requests-per-second, burst) pair, either the
+// global RateLimit default or a per-key KeyPolicy override.
+type rateLimitSpec struct {
+	rps   float64
+	burst int
+}
+
+// limiterEntry pairs a token bucket with the time it was last consulted, so
+// the sweeper can evict buckets that have gone idle.
+type limiterEntry struct {
+	limiter  *tokenBucket
+	lastUsed atomic.Int64 // UnixNano
+}
+
+// tokenBucket is a minimal token-bucket limiter, refilled lazily on each
+// take() call rather than by a background goroutine. Safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rps    float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket that starts full, matching
+// golang.org/x/time/rate.NewLimiter's behavior of allowing an initial burst.
+func newTokenBucket(rps float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rps:    rps,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take attempts to consume a single token, refilling the bucket for elapsed
+// time first. It returns whether the token was granted, the tokens left
+// afterward, and - only when denied - how long the caller should wait
+// before a token becomes available.
+func (b *tokenBucket) take() (bool, int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rps
+		if max := float64(b.burst); b.tokens > max {
+			b.tokens = max
+		}
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, int(b.tokens), 0
+	}
+
+	var wait time.Duration
+	if b.rps > 0 {
+		wait = time.Duration((1 - b.tokens) / b.rps * float64(time.Second))
+	}
+	return false, 0, wait
+}
+
+// rateLimiter enforces a per-key token bucket, lazily creating a tokenBucket
+// per matched key and periodically evicting ones that have been idle longer
+// than idleTTL so memory doesn't grow unbounded across a long-lived key set.
+type rateLimiter struct {
+	defaultRPS   float64
+	defaultBurst int
+	overrides    map[string]rateLimitSpec
+	idleTTL      time.Duration
+	limiters     sync.Map // string -> *limiterEntry
+}
+
+// newRateLimiter returns nil unless a global RateLimitRequestsPerSecond is
+// configured, which keeps ServeHTTP's hot path free of any rate-limiting
+// overhead for plugin instances that don't use this feature. KeyPolicy rate
+// limit fields only ever tune this global baseline for a specific key - they
+// cannot turn rate limiting on by themselves, since a burst-only override
+// with no RPS anywhere would otherwise leave that key permanently exhausted.
+func newRateLimiter(ctx context.Context, config *Config) *rateLimiter {
+	if config.RateLimitRequestsPerSecond <= 0 {
+		return nil
+	}
+
+	defaultBurst := config.RateLimitBurst
+	if defaultBurst <= 0 {
+		defaultBurst = 1
+	}
+
+	overrides := make(map[string]rateLimitSpec)
+	for _, keyPolicy := range config.KeyPolicies {
+		if keyPolicy.RateLimitRequestsPerSecond <= 0 && keyPolicy.RateLimitBurst <= 0 {
+			continue
+		}
+		spec := rateLimitSpec{rps: config.RateLimitRequestsPerSecond, burst: defaultBurst}
+		if keyPolicy.RateLimitRequestsPerSecond > 0 {
+			spec.rps = keyPolicy.RateLimitRequestsPerSecond
+		}
+		if keyPolicy.RateLimitBurst > 0 {
+			spec.burst = keyPolicy.RateLimitBurst
+		}
+		overrides[keyPolicy.Key] = spec
+	}
+
+	idleTTL := config.RateLimitIdleTTL
+	if idleTTL <= 0 {
+		idleTTL = 10 * time.Minute
+	}
+
+	rl := &rateLimiter{
+		defaultRPS:   config.RateLimitRequestsPerSecond,
+		defaultBurst: defaultBurst,
+		overrides:    overrides,
+		idleTTL:      idleTTL,
+	}
+	go rl.sweep(ctx)
+	return rl
+}
+
+// sweep evicts limiters that have not been consulted in the last idleTTL, until ctx is cancelled.
+func (r *rateLimiter) sweep(ctx context.Context) {
+	ticker := time.NewTicker(r.idleTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-r.idleTTL).UnixNano()
+			r.limiters.Range(func(key, value any) bool {
+				if value.(*limiterEntry).lastUsed.Load() < cutoff {
+					r.limiters.Delete(key)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// allow consults (lazily creating) the token bucket for key, returning
+// whether the request is allowed, the tokens remaining, the bucket's burst
+// size, and - only when denied - how long the caller should wait before retrying.
+func (r *rateLimiter) allow(key string) (bool, int, int, time.Duration) {
+	spec, ok := r.overrides[key]
+	if !ok {
+		spec = rateLimitSpec{rps: r.defaultRPS, burst: r.defaultBurst}
+	}
+	if spec.burst <= 0 {
+		spec.burst = 1
+	}
+
+	entryAny, _ := r.limiters.LoadOrStore(key, &limiterEntry{limiter: newTokenBucket(spec.rps, spec.burst)})
+	entry := entryAny.(*limiterEntry)
+	entry.lastUsed.Store(time.Now().UnixNano())
+
+	allowed, remaining, wait := entry.limiter.take()
+	if !allowed {
+		return false, 0, spec.burst, wait
+	}
+	return true, remaining, spec.burst, 0
+}
+
+// compiledPolicy is the pre-compiled form of a KeyPolicy: the regex is
+// compiled once here instead of on every request.
+type compiledPolicy struct {
+	methods         map[string]bool
+	pathPrefixes    []string
+	pathRegex       *regexp.Regexp
+	forwardIdentity string
+}
+
+// allows reports whether method/path are permitted by this policy. An empty
+// Methods/PathPrefixes/PathRegex constraint is treated as "any".
+func (p *compiledPolicy) allows(method, path string) bool {
+	if len(p.methods) > 0 && !p.methods[strings.ToUpper(method)] {
+		return false
+	}
+
+	if len(p.pathPrefixes) > 0 {
+		matched := false
+		for _, prefix := range p.pathPrefixes {
+			if strings.HasPrefix(path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if p.pathRegex != nil && !p.pathRegex.MatchString(path) {
+		return false
+	}
+
+	return true
+}
+
+// tokenReviewRequest is the Kubernetes-style TokenReview request body POSTed
+// to WebhookURL, modelled on authentication.k8s.io/v1.
+type tokenReviewRequest struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Spec       tokenReviewSpec `json:"spec"`
+}
+
+type tokenReviewSpec struct {
+	Token string `json:"token"`
+}
+
+type tokenReviewResponse struct {
+	Status tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool            `json:"authenticated"`
+	User          tokenReviewUser `json:"user"`
+}
+
+type tokenReviewUser struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+}
+
+// webhookDecision is the outcome of a (possibly cached) TokenReview call.
+type webhookDecision struct {
+	authenticated bool
+	username      string
+	groups        string // comma-joined, ready to forward as a header value
+}
+
+// webhookAuthenticator delegates token validation to an external HTTPS
+// endpoint instead of (or alongside) the local Keys/HashedKeys lists, the
+// way a Pinniped-style webhook token authenticator would.
+type webhookAuthenticator struct {
+	url            string
+	client         *http.Client
+	forwardHeaders map[string]string // claim ("username"/"groups") -> header name
+	cache          *webhookCache
+}
+
+// newWebhookAuthenticator builds a webhookAuthenticator from config, or
+// returns a nil authenticator (and no error) when WebhookURL is unset.
+func newWebhookAuthenticator(config *Config) (*webhookAuthenticator, error) {
+	if config.WebhookURL == "" {
+		return nil, nil
+	}
+
+	timeout := config.WebhookTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	if config.WebhookCACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.WebhookCACert)) {
+			return nil, fmt.Errorf("webhookCACert does not contain a valid PEM certificate")
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	forwardHeaders, err := parseWebhookForwardHeaders(config.WebhookForwardHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheSize := config.WebhookCacheSize
+	if cacheSize <= 0 {
+		cacheSize = 1024
+	}
+
+	return &webhookAuthenticator{
+		url:            config.WebhookURL,
+		client:         client,
+		forwardHeaders: forwardHeaders,
+		cache:          newWebhookCache(cacheSize, config.WebhookCacheHitTTL, config.WebhookCacheMissTTL),
+	}, nil
+}
+
+// parseWebhookForwardHeaders parses entries of the form "claim:headerName",
+// where claim is either "username" or "groups".
+func parseWebhookForwardHeaders(entries []string) (map[string]string, error) {
+	headers := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid webhookForwardHeaders entry %q: expected claim:headerName", entry)
+		}
+		claim, header := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if claim != "username" && claim != "groups" {
+			return nil, fmt.Errorf("invalid webhookForwardHeaders entry %q: claim must be \"username\" or \"groups\"", entry)
+		}
+		headers[claim] = header
+	}
+	return headers, nil
+}
+
+// authenticate checks token against the webhook, consulting the cache
+// first. The returned decision's authenticated field reports whether the
+// token was accepted.
+func (w *webhookAuthenticator) authenticate(token string) webhookDecision {
+	sum := sha256.Sum256([]byte(token))
+	cacheKey := hex.EncodeToString(sum[:])
+
+	if decision, ok := w.cache.get(cacheKey); ok {
+		return decision
+	}
+
+	decision := w.review(token)
+	w.cache.set(cacheKey, decision)
+	return decision
+}
+
+// review POSTs a TokenReview to the webhook and parses the result. Any
+// transport, status or decode error is treated as "not authenticated" -
+// webhooks fail closed, unlike the key file/URL refresh in this plugin.
+func (w *webhookAuthenticator) review(token string) webhookDecision {
+	body, err := json.Marshal(tokenReviewRequest{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		fmt.Printf("ERROR: traefik_api_key_auth webhook: failed to marshal TokenReview: %s\n", err.Error())
+		return webhookDecision{}
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("ERROR: traefik_api_key_auth webhook: request to %s failed: %s\n", w.url, err.Error())
+		return webhookDecision{}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Printf("ERROR: traefik_api_key_auth webhook: unexpected status %d from %s\n", resp.StatusCode, w.url)
+		return webhookDecision{}
+	}
+
+	var review tokenReviewResponse
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		fmt.Printf("ERROR: traefik_api_key_auth webhook: failed to decode response from %s: %s\n", w.url, err.Error())
+		return webhookDecision{}
+	}
+
+	if !review.Status.Authenticated {
+		return webhookDecision{}
+	}
+
+	return webhookDecision{
+		authenticated: true,
+		username:      review.Status.User.Username,
+		groups:        strings.Join(review.Status.User.Groups, ","),
+	}
+}
+
+// forward sets the configured username/groups headers on a successfully authenticated request.
+func (w *webhookAuthenticator) forward(req *http.Request, decision webhookDecision) {
+	if name, ok := w.forwardHeaders["username"]; ok && name != "" {
+		req.Header.Set(name, decision.username)
+	}
+	if name, ok := w.forwardHeaders["groups"]; ok && name != "" {
+		req.Header.Set(name, decision.groups)
+	}
+}
+
+// webhookCache is an LRU cache of webhookDecisions keyed by SHA-256(token),
+// with separate TTLs for positive and negative decisions so a flood of
+// invalid tokens can't drive unbounded webhook QPS.
+type webhookCache struct {
+	mu      sync.Mutex
+	size    int
+	hitTTL  time.Duration
+	missTTL time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type webhookCacheEntry struct {
+	key      string
+	decision webhookDecision
+	expires  time.Time
+}
+
+func newWebhookCache(size int, hitTTL, missTTL time.Duration) *webhookCache {
+	return &webhookCache{
+		size:    size,
+		hitTTL:  hitTTL,
+		missTTL: missTTL,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *webhookCache) get(key string) (webhookDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return webhookDecision{}, false
+	}
+	entry := elem.Value.(webhookCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return webhookDecision{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.decision, true
+}
+
+func (c *webhookCache) set(key string, decision webhookDecision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ttl := c.missTTL
+	if decision.authenticated {
+		ttl = c.hitTTL
+	}
+	entry := webhookCacheEntry{key: key, decision: decision, expires: time.Now().Add(ttl)}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	elem := c.order.PushFront(entry)
+	c.entries[key] = elem
+
+	if c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(webhookCacheEntry).key)
+		}
+	}
+}
+
 // contains takes an API key and compares it to the list of valid API keys. The return value notes whether the
 // key is in the valid keys
 // list or not.
@@ -111,22 +1064,245 @@ func contains(key string, validKeys []string, exact bool) string {
 	return ""
 }
 
-// bearer takes an API key in the `Authorization: Bearer $token` form and compares it to the list of valid keys.
-// The token/key is extracted from the header value. The return value notes whether the key is in the valid keys
-// list or not.
-func bearer(key string, validKeys []string) string {
-	re, _ := regexp.Compile(`Bearer\s(?P<key>[^$]+)`)
-	matches := re.FindStringSubmatch(key)
+// hashCacheEntry is a single cached hashed-key comparison outcome.
+type hashCacheEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// hashCache is a fixed-size, TTL-bounded LRU cache mapping SHA-256(token) to
+// the label (see hashLabel) of the hashed key it matched, so repeated requests with the same token don't
+// pay the cost of re-deriving the pbkdf2-sha256 hash on every call. It is
+// safe for concurrent use.
+type hashCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newHashCache(size int, ttl time.Duration) *hashCache {
+	return &hashCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *hashCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// If no match found the value is in the wrong form.
-	if matches == nil {
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(hashCacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *hashCache) set(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Time{}
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = hashCacheEntry{key: key, value: value, expires: expires}
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	elem := c.order.PushFront(hashCacheEntry{key: key, value: value, expires: expires})
+	c.entries[key] = elem
+
+	if c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(hashCacheEntry).key)
+		}
+	}
+}
+
+// hashLabel returns the identifier forwarded for a matched hashed key. The
+// full hash is never forwarded downstream, only a short, non-secret prefix
+// of its salt, suitable for logging and header propagation.
+func hashLabel(hash string) string {
+	const labelLen = 12
+	// Skip the "$pbkdf2-sha256$<iterations>$" header, which is the same for
+	// every key, so the label starts at the per-key salt.
+	if parts := strings.SplitN(hash, "$", 4); len(parts) == 4 {
+		hash = parts[3]
+	}
+	if len(hash) <= labelLen {
+		return hash
+	}
+	return hash[:labelLen]
+}
+
+// containsHashed compares a candidate token against the configured
+// pbkdf2-sha256-hashed keys, consulting the cache before falling back to
+// compareHashedKey. The comparison itself is constant time; only the cache
+// lookup and the order in which hashes are tried are not.
+func containsHashed(token string, hashedKeys []string, cache *hashCache) string {
+	if len(hashedKeys) == 0 {
 		return ""
 	}
 
-	// If found extract the key and compare it to the list of valid keys
-	keyIndex := re.SubexpIndex("key")
-	extractedKey := matches[keyIndex]
-	return contains(extractedKey, validKeys, true)
+	sum := sha256.Sum256([]byte(token))
+	cacheKey := hex.EncodeToString(sum[:])
+
+	if cache != nil {
+		if matched, ok := cache.get(cacheKey); ok {
+			return matched
+		}
+	}
+
+	for _, hashedKey := range hashedKeys {
+		if compareHashedKey(hashedKey, token) {
+			matched := hashLabel(hashedKey)
+			if cache != nil {
+				cache.set(cacheKey, matched)
+			}
+			return matched
+		}
+	}
+	return ""
+}
+
+// hashedKeyPrefix identifies the encoding produced by HashKey and consumed by
+// compareHashedKey: "$pbkdf2-sha256$<iterations>$<base64 salt>$<base64 hash>".
+const hashedKeyPrefix = "pbkdf2-sha256"
+
+// defaultHashIterations is OWASP's current minimum recommendation for
+// PBKDF2-HMAC-SHA256 and is used by HashKey when generating new entries.
+const defaultHashIterations = 210000
+
+const (
+	hashedKeySaltLen = 16
+	hashedKeyKeyLen  = 32
+)
+
+// HashKey derives a hashedKeys entry for secret, suitable for pasting into
+// Config.HashedKeys. It is exported so operators can generate entries from a
+// throwaway Go program without needing external tooling.
+func HashKey(secret string) (string, error) {
+	salt := make([]byte, hashedKeySaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generating salt: %w", err)
+	}
+	derived := derivePBKDF2SHA256([]byte(secret), salt, defaultHashIterations, hashedKeyKeyLen)
+	return encodeHashedKey(defaultHashIterations, salt, derived), nil
+}
+
+// encodeHashedKey renders the components of a hashed key into the
+// "$pbkdf2-sha256$<iterations>$<salt>$<hash>" wire format.
+func encodeHashedKey(iterations int, salt, derived []byte) string {
+	return fmt.Sprintf("$%s$%d$%s$%s", hashedKeyPrefix,
+		iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(derived))
+}
+
+// parseHashedKey splits a "$pbkdf2-sha256$<iterations>$<salt>$<hash>" entry
+// into its components, rejecting anything else so a misconfigured hashedKeys
+// entry is caught at startup rather than silently never matching.
+func parseHashedKey(encoded string) (iterations int, salt, derived []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != hashedKeyPrefix {
+		return 0, nil, nil, fmt.Errorf("not a %s hash", hashedKeyPrefix)
+	}
+
+	iterations, err = strconv.Atoi(parts[2])
+	if err != nil || iterations <= 0 {
+		return 0, nil, nil, fmt.Errorf("invalid iteration count %q", parts[2])
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid salt encoding: %w", err)
+	}
+
+	derived, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid hash encoding: %w", err)
+	}
+
+	return iterations, salt, derived, nil
+}
+
+// compareHashedKey reports whether token, re-derived with the iteration
+// count and salt embedded in encoded, matches it. The final comparison is
+// constant time; parsing the encoded hash is not secret-dependent.
+func compareHashedKey(encoded, token string) bool {
+	iterations, salt, derived, err := parseHashedKey(encoded)
+	if err != nil {
+		return false
+	}
+
+	candidate := derivePBKDF2SHA256([]byte(token), salt, iterations, len(derived))
+	return subtle.ConstantTimeCompare(candidate, derived) == 1
+}
+
+// derivePBKDF2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256 as the
+// pseudorandom function.
+func derivePBKDF2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	mac := hmac.New(sha256.New, password)
+	hashLen := mac.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	derived := make([]byte, 0, numBlocks*hashLen)
+	blockIndex := make([]byte, 4)
+	for block := 1; block <= numBlocks; block++ {
+		binary.BigEndian.PutUint32(blockIndex, uint32(block))
+
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(blockIndex)
+		u := mac.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+
+		for n := 2; n <= iterations; n++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(nil)
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+
+		derived = append(derived, t...)
+	}
+
+	return derived[:keyLen]
+}
+
+// matchKey checks a candidate token against the configured plaintext keys
+// and, if present, the pbkdf2-sha256-hashed keys. Hashed keys are only
+// considered for exact matches, since the hash has no notion of "contains".
+func matchKey(token string, plainKeys []string, hashedKeys []string, cache *hashCache, exact bool) string {
+	if matched := contains(token, plainKeys, exact); matched != "" {
+		return matched
+	}
+	if exact {
+		return containsHashed(token, hashedKeys, cache)
+	}
+	return ""
 }
 
 func (ka *KeyAuth) ok(rw http.ResponseWriter, req *http.Request, key string) {
@@ -138,56 +1314,98 @@ func (ka *KeyAuth) ok(rw http.ResponseWriter, req *http.Request, key string) {
 	ka.next.ServeHTTP(rw, req)
 }
 
+// shouldRemove reports whether a successfully matched token should be
+// stripped from its source. Only the source that actually matched is ever
+// touched: RemoveQueryParamsOnSuccess governs the query source, while
+// RemoveHeadersOnSuccess covers headers, cookies and form fields alike.
+func (ka *KeyAuth) shouldRemove(source lookupSource) bool {
+	switch source {
+	case sourceQuery:
+		return ka.removeQueryParamsOnSuccess
+	case sourceHeader, sourceCookie, sourceForm:
+		return ka.removeHeadersOnSuccess
+	default:
+		return false
+	}
+}
+
 func (ka *KeyAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// Check authentication header for valid key
-	if ka.authenticationHeader {
-		var matchedKey = contains(req.Header.Get(ka.authenticationHeaderName), ka.keys, true)
-		if matchedKey != "" {
-			// X-API-KEY header contains a valid key
-			if ka.removeHeadersOnSuccess {
-				req.Header.Del(ka.authenticationHeaderName)
-			}
-			ka.ok(rw, req, matchedKey)
-			return
+	for _, lookup := range ka.lookups {
+		token, remove := lookup.extract(req)
+		if token == "" {
+			continue
 		}
-	}
 
-	// Check authorization header for valid Bearer
-	if ka.bearerHeader {
-		var matchedKey = bearer(req.Header.Get(ka.bearerHeaderName), ka.keys)
-		if matchedKey != "" {
-			// Authorization header contains a valid Bearer token
-			if ka.removeHeadersOnSuccess {
-				req.Header.Del(ka.bearerHeaderName)
+		matchedKey := matchKey(token, ka.keys, ka.hashedKeys, ka.hashedKeyCache, lookup.exact)
+		if matchedKey == "" && lookup.exact {
+			matchedKey = ka.dynamicKeys.match(token)
+		}
+		if matchedKey == "" && lookup.exact && ka.webhook != nil {
+			if decision := ka.webhook.authenticate(token); decision.authenticated {
+				ka.webhook.forward(req, decision)
+				matchedKey = decision.username
+				if matchedKey == "" {
+					// No username claim: derive a per-token identifier so unrelated
+					// callers don't share one rate-limit bucket or forwarded identity.
+					sum := sha256.Sum256([]byte(token))
+					matchedKey = "webhook:" + hex.EncodeToString(sum[:])[:12]
+				}
 			}
-			ka.ok(rw, req, matchedKey)
+		}
+		if matchedKey == "" {
+			continue
+		}
+
+		if policy, ok := ka.policies[matchedKey]; ok && !policy.allows(req.Method, req.URL.Path) {
+			ka.reject(rw, req)
 			return
+		} else if ok && policy.forwardIdentity != "" {
+			req.Header.Set(policy.forwardIdentity, matchedKey)
 		}
-	}
 
-	// Check query param for valid key
-	if ka.queryParam {
-		var qs = req.URL.Query()
-		var matchedKey = contains(qs.Get(ka.queryParamName), ka.keys, true)
-		if matchedKey != "" {
-			if ka.removeQueryParamsOnSuccess{
-				qs.Del(ka.queryParamName)
+		if ka.rateLimiter != nil {
+			allowed, remaining, limit, retryAfter := ka.rateLimiter.allow(matchedKey)
+			rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+			if !allowed {
+				ka.tooManyRequests(rw, retryAfter)
+				return
 			}
-			req.URL.RawQuery = qs.Encode()
-			ka.ok(rw, req, matchedKey)
-			return
+			rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
 		}
-	}
 
-	// Check URL path for valid key in segment
-	if ka.pathSegment {
-		var matchedKey = contains(req.URL.Path, ka.keys, false)
-		if matchedKey != "" {
-			ka.ok(rw, req, matchedKey)
-			return
+		if remove != nil && ka.shouldRemove(lookup.source) {
+			remove(req)
 		}
+		ka.ok(rw, req, matchedKey)
+		return
 	}
 
+	ka.reject(rw, req)
+}
+
+// tooManyRequests responds 429 with a Retry-After header, matching the
+// existing Response JSON shape used for the 403 path.
+func (ka *KeyAuth) tooManyRequests(rw http.ResponseWriter, retryAfter time.Duration) {
+	retrySeconds := int(retryAfter/time.Second) + 1
+	rw.Header().Set("Retry-After", strconv.Itoa(retrySeconds))
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var response = Response{
+		Message:    "Rate limit exceeded",
+		StatusCode: http.StatusTooManyRequests,
+	}
+	rw.WriteHeader(response.StatusCode)
+
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		fmt.Printf("Error when sending response to a rate limited request: %s", err.Error())
+	}
+}
+
+// reject denies the request: if InternalErrorRoute is configured it rewrites
+// the request path to it and clears the query, without calling the next
+// handler; otherwise it writes the standard 403 JSON response. Used both for a missing
+// or invalid key and for a key whose KeyPolicy doesn't permit this request.
+func (ka *KeyAuth) reject(rw http.ResponseWriter, req *http.Request) {
 	if ka.internalErrorRoute != "" {
 		req.URL.Path = ka.internalErrorRoute
 		req.URL.RawQuery = ""
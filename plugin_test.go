@@ -0,0 +1,719 @@
+package traefik_api_key_auth
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingHandler is the http.Handler KeyAuth.ServeHTTP forwards to on
+// success; it records the request it received so tests can assert on
+// forwarded headers and the body that actually reached the backend.
+type recordingHandler struct {
+	called  bool
+	header  http.Header
+	body    string
+	urlPath string
+}
+
+func (h *recordingHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.called = true
+	h.header = req.Header.Clone()
+	h.urlPath = req.URL.Path
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		h.body = string(body)
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// TestServeHTTPKeysFileAuth proves a KeysFile snapshot, loaded synchronously
+// during New, actually authenticates a request through ServeHTTP.
+func TestServeHTTPKeysFileAuth(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(keysFile, []byte("file-key-one\nfile-key-two\n"), 0o600); err != nil {
+		t.Fatalf("writing keys file: %v", err)
+	}
+
+	cfg := CreateConfig()
+	cfg.Keys = nil
+	cfg.KeysFile = keysFile
+
+	next := &recordingHandler{}
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-KEY", "file-key-two")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if !next.called {
+		t.Fatalf("next handler was not called")
+	}
+
+	next = &recordingHandler{}
+	handler, err = New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-KEY", "not-in-the-file")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusForbidden)
+	}
+	if next.called {
+		t.Fatalf("next handler should not have been called")
+	}
+}
+
+// TestServeHTTPRateLimitEnforcement proves a burst-exhausting request is
+// rejected with a 429, Retry-After and X-RateLimit-* headers through
+// ServeHTTP, while requests within the burst still succeed with their own
+// X-RateLimit-Remaining.
+func TestServeHTTPRateLimitEnforcement(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Keys = []string{"limited-key"}
+	cfg.RateLimitRequestsPerSecond = 1
+	cfg.RateLimitBurst = 1
+
+	next := &recordingHandler{}
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-KEY", "limited-key")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if remaining := rw.Header().Get("X-RateLimit-Remaining"); remaining != "0" {
+		t.Errorf("first request: X-RateLimit-Remaining = %q, want %q", remaining, "0")
+	}
+
+	next.called = false
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-KEY", "limited-key")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status = %d, want %d", rw.Code, http.StatusTooManyRequests)
+	}
+	if next.called {
+		t.Fatalf("second request: next handler should not have been called")
+	}
+	if retryAfter := rw.Header().Get("Retry-After"); retryAfter == "" {
+		t.Errorf("second request: Retry-After header missing")
+	}
+	if limit := rw.Header().Get("X-RateLimit-Limit"); limit != "1" {
+		t.Errorf("second request: X-RateLimit-Limit = %q, want %q", limit, "1")
+	}
+}
+
+// TestServeHTTPKeyPolicyEnforcement proves a KeyPolicy actually gates
+// requests through ServeHTTP: an authenticated key is still rejected with a
+// 403 once it hits a method or path the policy doesn't allow.
+func TestServeHTTPKeyPolicyEnforcement(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Keys = nil
+	cfg.KeyPolicies = []KeyPolicy{
+		{Key: "scoped-key", Methods: []string{"GET"}, PathPrefixes: []string{"/allowed/"}},
+	}
+
+	build := func() (http.Handler, *recordingHandler) {
+		next := &recordingHandler{}
+		handler, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatalf("New: unexpected error: %v", err)
+		}
+		return handler, next
+	}
+
+	t.Run("allowed method and path succeeds", func(t *testing.T) {
+		handler, next := build()
+		req := httptest.NewRequest(http.MethodGet, "/allowed/resource", nil)
+		req.Header.Set("X-API-KEY", "scoped-key")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+		}
+		if !next.called {
+			t.Fatalf("next handler was not called")
+		}
+	})
+
+	t.Run("disallowed method is rejected", func(t *testing.T) {
+		handler, next := build()
+		req := httptest.NewRequest(http.MethodPost, "/allowed/resource", nil)
+		req.Header.Set("X-API-KEY", "scoped-key")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusForbidden {
+			t.Fatalf("status = %d, want %d", rw.Code, http.StatusForbidden)
+		}
+		if next.called {
+			t.Fatalf("next handler should not have been called")
+		}
+	})
+
+	t.Run("disallowed path is rejected", func(t *testing.T) {
+		handler, next := build()
+		req := httptest.NewRequest(http.MethodGet, "/other/resource", nil)
+		req.Header.Set("X-API-KEY", "scoped-key")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusForbidden {
+			t.Fatalf("status = %d, want %d", rw.Code, http.StatusForbidden)
+		}
+		if next.called {
+			t.Fatalf("next handler should not have been called")
+		}
+	})
+}
+
+// TestServeHTTPWebhookAuth drives ServeHTTP against a fake TokenReview
+// webhook, proving both that a successful review forwards the username/
+// groups claims as headers and that a failed review still falls through to
+// the standard 403.
+func TestServeHTTPWebhookAuth(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var review tokenReviewRequest
+		if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+			t.Fatalf("webhook: decoding TokenReview request: %v", err)
+		}
+
+		resp := tokenReviewResponse{}
+		if review.Spec.Token == "valid-token" {
+			resp.Status = tokenReviewStatus{
+				Authenticated: true,
+				User:          tokenReviewUser{Username: "alice", Groups: []string{"admins", "devs"}},
+			}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(resp)
+	}))
+	defer webhook.Close()
+
+	cfg := CreateConfig()
+	cfg.Keys = nil
+	cfg.WebhookURL = webhook.URL
+	cfg.WebhookForwardHeaders = []string{"username:X-Webhook-User", "groups:X-Webhook-Groups"}
+
+	build := func() (http.Handler, *recordingHandler) {
+		next := &recordingHandler{}
+		handler, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatalf("New: unexpected error: %v", err)
+		}
+		return handler, next
+	}
+
+	t.Run("authenticated token forwards username and groups headers", func(t *testing.T) {
+		handler, next := build()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-KEY", "valid-token")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+		}
+		if got := next.header.Get("X-Webhook-User"); got != "alice" {
+			t.Errorf("X-Webhook-User = %q, want %q", got, "alice")
+		}
+		if got := next.header.Get("X-Webhook-Groups"); got != "admins,devs" {
+			t.Errorf("X-Webhook-Groups = %q, want %q", got, "admins,devs")
+		}
+	})
+
+	t.Run("unauthenticated token falls through to 403", func(t *testing.T) {
+		handler, next := build()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-KEY", "bad-token")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusForbidden {
+			t.Fatalf("status = %d, want %d", rw.Code, http.StatusForbidden)
+		}
+		if next.called {
+			t.Fatalf("next handler should not have been called")
+		}
+	})
+}
+
+// TestServeHTTPTokenLookupCascade drives a TokenLookup DSL with a header,
+// query and form source, proving that ServeHTTP tries them in declared
+// order and that a form: match still forwards the original request body to
+// the backend (the form lookup used to drain it with nothing refilling it).
+func TestServeHTTPTokenLookupCascade(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AuthenticationHeader = false
+	cfg.BearerHeader = false
+	cfg.QueryParam = false
+	cfg.PathSegment = false
+	cfg.TokenLookup = "header:X-API-KEY,query:token,form:apikey"
+	cfg.Keys = []string{"header-secret", "query-secret", "form-secret"}
+
+	build := func() (http.Handler, *recordingHandler) {
+		next := &recordingHandler{}
+		handler, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatalf("New: unexpected error: %v", err)
+		}
+		return handler, next
+	}
+
+	t.Run("header wins over query and form", func(t *testing.T) {
+		handler, next := build()
+		req := httptest.NewRequest(http.MethodGet, "/?token=query-secret", nil)
+		req.Header.Set("X-API-KEY", "header-secret")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+		}
+		if !next.called {
+			t.Fatalf("next handler was not called")
+		}
+	})
+
+	t.Run("cascades past a non-matching header to query", func(t *testing.T) {
+		handler, next := build()
+		req := httptest.NewRequest(http.MethodGet, "/?token=query-secret", nil)
+		req.Header.Set("X-API-KEY", "not-a-real-key")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+		}
+		if !next.called {
+			t.Fatalf("next handler was not called")
+		}
+	})
+
+	t.Run("form match forwards the original body untouched", func(t *testing.T) {
+		handler, next := build()
+		const formBody = "apikey=form-secret&other_field=important-data"
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(formBody))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+		}
+		if !next.called {
+			t.Fatalf("next handler was not called")
+		}
+		if next.body != formBody {
+			t.Errorf("body forwarded to backend = %q, want %q", next.body, formBody)
+		}
+	})
+}
+
+func TestServeHTTPHashedKeyAuth(t *testing.T) {
+	hashed, err := HashKey("super-secret-token")
+	if err != nil {
+		t.Fatalf("HashKey: unexpected error: %v", err)
+	}
+
+	cfg := CreateConfig()
+	cfg.Keys = nil
+	cfg.HashedKeys = []string{hashed}
+
+	next := &recordingHandler{}
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-KEY", "super-secret-token")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("correct hashed key: status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if !next.called {
+		t.Fatalf("correct hashed key: next handler was not called")
+	}
+
+	next = &recordingHandler{}
+	handler, err = New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-KEY", "wrong-token")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("wrong token: status = %d, want %d", rw.Code, http.StatusForbidden)
+	}
+	if next.called {
+		t.Fatalf("wrong token: next handler should not have been called")
+	}
+}
+
+func TestWebhookCacheTTLSplit(t *testing.T) {
+	hitTTL := 50 * time.Millisecond
+	missTTL := 500 * time.Millisecond
+	cache := newWebhookCache(10, hitTTL, missTTL)
+
+	cache.set("authenticated", webhookDecision{authenticated: true, username: "alice"})
+	cache.set("denied", webhookDecision{authenticated: false})
+
+	if decision, ok := cache.get("authenticated"); !ok || decision.username != "alice" {
+		t.Fatalf("get(authenticated) immediately after set = %+v, %v, want alice, true", decision, ok)
+	}
+	if _, ok := cache.get("denied"); !ok {
+		t.Fatalf("get(denied) immediately after set: ok = false, want true")
+	}
+
+	// Past the short hit TTL, but still short of the longer miss TTL: the
+	// positive decision should have expired while the negative one hasn't.
+	time.Sleep(hitTTL + 10*time.Millisecond)
+
+	if _, ok := cache.get("authenticated"); ok {
+		t.Errorf("get(authenticated) after hitTTL elapsed: ok = true, want false")
+	}
+	if _, ok := cache.get("denied"); !ok {
+		t.Errorf("get(denied) after hitTTL (but before missTTL) elapsed: ok = false, want true")
+	}
+}
+
+func TestHashedKeyRoundTrip(t *testing.T) {
+	hashed, err := HashKey("super-secret-token")
+	if err != nil {
+		t.Fatalf("HashKey: unexpected error: %v", err)
+	}
+
+	if !compareHashedKey(hashed, "super-secret-token") {
+		t.Errorf("compareHashedKey: correct token did not match %q", hashed)
+	}
+	if compareHashedKey(hashed, "wrong-token") {
+		t.Errorf("compareHashedKey: wrong token matched %q", hashed)
+	}
+
+	iterations, salt, derived, err := parseHashedKey(hashed)
+	if err != nil {
+		t.Fatalf("parseHashedKey(%q): unexpected error: %v", hashed, err)
+	}
+	if iterations != defaultHashIterations {
+		t.Errorf("parseHashedKey: iterations = %d, want %d", iterations, defaultHashIterations)
+	}
+	if len(salt) != hashedKeySaltLen {
+		t.Errorf("parseHashedKey: salt length = %d, want %d", len(salt), hashedKeySaltLen)
+	}
+	if len(derived) != hashedKeyKeyLen {
+		t.Errorf("parseHashedKey: derived length = %d, want %d", len(derived), hashedKeyKeyLen)
+	}
+}
+
+func TestParseHashedKeyRejectsMalformedInput(t *testing.T) {
+	tests := []string{
+		"",
+		"not-a-hash-at-all",
+		"$bcrypt$10$salt$hash",
+		"$pbkdf2-sha256$not-a-number$c2FsdA$aGFzaA",
+		"$pbkdf2-sha256$100$not-base64!!$aGFzaA",
+	}
+
+	for _, encoded := range tests {
+		if _, _, _, err := parseHashedKey(encoded); err == nil {
+			t.Errorf("parseHashedKey(%q): expected an error, got none", encoded)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(1, 3)
+
+	for i := 0; i < 3; i++ {
+		allowed, remaining, wait := bucket.take()
+		if !allowed {
+			t.Fatalf("take() #%d: allowed = false, want true (burst not yet exhausted)", i)
+		}
+		if wait != 0 {
+			t.Errorf("take() #%d: wait = %v, want 0 when allowed", i, wait)
+		}
+		if want := 2 - i; remaining != want {
+			t.Errorf("take() #%d: remaining = %d, want %d", i, remaining, want)
+		}
+	}
+
+	allowed, _, wait := bucket.take()
+	if allowed {
+		t.Fatalf("take() after burst exhausted: allowed = true, want false")
+	}
+	if wait <= 0 {
+		t.Errorf("take() after burst exhausted: wait = %v, want > 0", wait)
+	}
+}
+
+func TestTokenBucketRefillsOverTime(t *testing.T) {
+	bucket := newTokenBucket(1, 1)
+
+	allowed, _, _ := bucket.take()
+	if !allowed {
+		t.Fatalf("first take(): allowed = false, want true")
+	}
+
+	allowed, _, _ = bucket.take()
+	if allowed {
+		t.Fatalf("second take() before any time passes: allowed = true, want false")
+	}
+
+	// Simulate the passage of time instead of sleeping in the test.
+	bucket.last = bucket.last.Add(-2 * time.Second)
+
+	allowed, _, _ = bucket.take()
+	if !allowed {
+		t.Fatalf("take() after simulated refill: allowed = false, want true")
+	}
+}
+
+func TestParseDynamicKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []dynamicKeyEntry
+	}{
+		{
+			name: "json document with ids",
+			data: `{"keys":[{"key":"abc","id":"team-a"},{"key":"def"}]}`,
+			want: []dynamicKeyEntry{{Key: "abc", ID: "team-a"}, {Key: "def"}},
+		},
+		{
+			name: "plain newline-delimited list",
+			data: "abc\ndef\n",
+			want: []dynamicKeyEntry{{Key: "abc"}, {Key: "def"}},
+		},
+		{
+			name: "plain list skips blank lines and comments",
+			data: "abc\n\n# a comment\ndef\n",
+			want: []dynamicKeyEntry{{Key: "abc"}, {Key: "def"}},
+		},
+		{
+			name: "empty json keys array falls back to line parsing, treating the document as one key line",
+			data: `{"keys":[]}`,
+			want: []dynamicKeyEntry{{Key: `{"keys":[]}`}},
+		},
+		{
+			name: "invalid json falls back to line parsing",
+			data: "not-json-but-a-key\n",
+			want: []dynamicKeyEntry{{Key: "not-json-but-a-key"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDynamicKeys([]byte(tt.data))
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseDynamicKeys(%q) = %+v, want %+v", tt.data, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("parseDynamicKeys(%q)[%d] = %+v, want %+v", tt.data, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseTokenLookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []tokenExtractor
+		wantErr bool
+	}{
+		{
+			name: "single header entry",
+			spec: "header:X-API-KEY",
+			want: []tokenExtractor{{source: sourceHeader, name: "X-API-KEY", exact: true, raw: "header:X-API-KEY"}},
+		},
+		{
+			name: "header entry with prefix",
+			spec: "header:Authorization:Bearer",
+			want: []tokenExtractor{{source: sourceHeader, name: "Authorization", prefix: "Bearer", exact: true, raw: "header:Authorization:Bearer"}},
+		},
+		{
+			name: "query entry",
+			spec: "query:token",
+			want: []tokenExtractor{{source: sourceQuery, name: "token", exact: true, raw: "query:token"}},
+		},
+		{
+			name: "cookie entry",
+			spec: "cookie:session",
+			want: []tokenExtractor{{source: sourceCookie, name: "session", exact: true, raw: "cookie:session"}},
+		},
+		{
+			name: "form entry",
+			spec: "form:api_key",
+			want: []tokenExtractor{{source: sourceForm, name: "api_key", exact: true, raw: "form:api_key"}},
+		},
+		{
+			name: "path entry with numeric segment index",
+			spec: "path:2",
+			want: []tokenExtractor{{source: sourcePath, pathIndex: 2, exact: true, raw: "path:2"}},
+		},
+		{
+			name: "multiple entries, blank entries and whitespace are ignored",
+			spec: " header:X-API-KEY , , query:token ",
+			want: []tokenExtractor{
+				{source: sourceHeader, name: "X-API-KEY", exact: true, raw: "header:X-API-KEY"},
+				{source: sourceQuery, name: "token", exact: true, raw: "query:token"},
+			},
+		},
+		{
+			name:    "missing name is an error",
+			spec:    "header",
+			wantErr: true,
+		},
+		{
+			name:    "unknown source is an error",
+			spec:    "bogus:foo",
+			wantErr: true,
+		},
+		{
+			name:    "non-numeric path segment is an error",
+			spec:    "path:first",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTokenLookup(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTokenLookup(%q): expected an error, got none", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTokenLookup(%q): unexpected error: %v", tt.spec, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseTokenLookup(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("parseTokenLookup(%q)[%d] = %+v, want %+v", tt.spec, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCompiledPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *compiledPolicy
+		method string
+		path   string
+		want   bool
+	}{
+		{
+			name:   "no constraints allows anything",
+			policy: &compiledPolicy{},
+			method: "GET",
+			path:   "/anything",
+			want:   true,
+		},
+		{
+			name:   "method allowed, case-insensitive",
+			policy: &compiledPolicy{methods: map[string]bool{"GET": true}},
+			method: "get",
+			path:   "/anything",
+			want:   true,
+		},
+		{
+			name:   "method not allowed",
+			policy: &compiledPolicy{methods: map[string]bool{"GET": true}},
+			method: "POST",
+			path:   "/anything",
+			want:   false,
+		},
+		{
+			name:   "path prefix matches",
+			policy: &compiledPolicy{pathPrefixes: []string{"/api/v1/"}},
+			method: "GET",
+			path:   "/api/v1/users",
+			want:   true,
+		},
+		{
+			name:   "path prefix does not match",
+			policy: &compiledPolicy{pathPrefixes: []string{"/api/v1/"}},
+			method: "GET",
+			path:   "/api/v2/users",
+			want:   false,
+		},
+		{
+			name:   "path regex matches",
+			policy: &compiledPolicy{pathRegex: regexp.MustCompile(`^/users/\d+$`)},
+			method: "GET",
+			path:   "/users/42",
+			want:   true,
+		},
+		{
+			name:   "path regex does not match",
+			policy: &compiledPolicy{pathRegex: regexp.MustCompile(`^/users/\d+$`)},
+			method: "GET",
+			path:   "/users/abc",
+			want:   false,
+		},
+		{
+			name: "all constraints must agree",
+			policy: &compiledPolicy{
+				methods:      map[string]bool{"GET": true},
+				pathPrefixes: []string{"/api/"},
+			},
+			method: "GET",
+			path:   "/other/",
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.allows(tt.method, tt.path); got != tt.want {
+				t.Errorf("allows(%q, %q) = %v, want %v", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}